@@ -0,0 +1,326 @@
+// Package certs loads TLS certificate/key pairs from a directory and serves
+// them through a tls.Config.GetCertificate callback selected by SNI.
+//
+// The directory is watched with fsnotify so operators can rotate certificates
+// without restarting imgproxy: every *.crt/*.key pair is recompiled into a new
+// lookup table and swapped in atomically. If a reload fails, the previous
+// good table keeps serving and the failure is only logged.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Manager loads certificate/key pairs from a directory and picks the right
+// one for a given TLS ClientHello based on SNI.
+type Manager struct {
+	certDir string
+	keyDir  string
+
+	mu    sync.RWMutex
+	table map[string]*tls.Certificate
+	def   *tls.Certificate
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// New creates a Manager that loads *.crt/*.key pairs from certDir/keyDir.
+// When certDir and keyDir are the same, pairs are matched by basename.
+func New(certDir, keyDir string) (*Manager, error) {
+	if len(keyDir) == 0 {
+		keyDir = certDir
+	}
+
+	m := &Manager{
+		certDir: certDir,
+		keyDir:  keyDir,
+		table:   make(map[string]*tls.Certificate),
+		done:    make(chan struct{}),
+	}
+
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// NewSelfSigned creates a Manager serving a single self-signed CA + leaf
+// certificate generated in memory. Intended for local development only.
+func NewSelfSigned(hosts []string) (*Manager, error) {
+	cert, err := generateSelfSigned(hosts)
+	if err != nil {
+		return nil, fmt.Errorf("can't generate self-signed certificate: %s", err)
+	}
+
+	m := &Manager{
+		table: make(map[string]*tls.Certificate),
+		def:   cert,
+		done:  make(chan struct{}),
+	}
+
+	for _, name := range hosts {
+		m.table[strings.ToLower(name)] = cert
+	}
+
+	return m, nil
+}
+
+// Watch starts watching the certificate directory for changes and recompiles
+// the lookup table whenever a .crt or .key file is created, written, or
+// removed. It is a no-op for self-signed managers, which have nothing to
+// watch.
+func (m *Manager) Watch() error {
+	if len(m.certDir) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("can't create certs watcher: %s", err)
+	}
+
+	if err = watcher.Add(m.certDir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("can't watch %s: %s", m.certDir, err)
+	}
+
+	if m.keyDir != m.certDir {
+		if err = watcher.Add(m.keyDir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("can't watch %s: %s", m.keyDir, err)
+		}
+	}
+
+	m.watcher = watcher
+
+	go m.watchLoop()
+
+	return nil
+}
+
+// Stop stops the directory watcher, if any.
+func (m *Manager) Stop() {
+	if m.watcher != nil {
+		close(m.done)
+		m.watcher.Close()
+	}
+}
+
+func (m *Manager) watchLoop() {
+	// Certificate rotation tools typically write several events (create,
+	// chmod, rename) per pair, so debounce reloads instead of reacting to
+	// every single fsnotify event.
+	var debounce *time.Timer
+
+	reload := func() {
+		if err := m.reload(); err != nil {
+			log.Warnf("Can't reload TLS certificates, keeping the previous ones: %s", err)
+		}
+	}
+
+	for {
+		select {
+		case <-m.done:
+			if debounce != nil {
+				debounce.Stop()
+			}
+			return
+		case event, ok := <-m.watcher.Events:
+			if !ok {
+				return
+			}
+
+			ext := strings.ToLower(filepath.Ext(event.Name))
+			if ext != ".crt" && ext != ".key" {
+				continue
+			}
+
+			if debounce != nil {
+				debounce.Stop()
+			}
+			debounce = time.AfterFunc(200*time.Millisecond, reload)
+		case err, ok := <-m.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warnf("TLS certs watcher error: %s", err)
+		}
+	}
+}
+
+// reload rebuilds the certificate table from disk and swaps it in atomically
+// on success. On failure the previously loaded table keeps serving.
+func (m *Manager) reload() error {
+	entries, err := os.ReadDir(m.certDir)
+	if err != nil {
+		return fmt.Errorf("can't read %s: %s", m.certDir, err)
+	}
+
+	table := make(map[string]*tls.Certificate)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".crt") {
+			continue
+		}
+
+		base := strings.TrimSuffix(entry.Name(), ".crt")
+		certPath := filepath.Join(m.certDir, entry.Name())
+		keyPath := filepath.Join(m.keyDir, base+".key")
+
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			log.Warnf("Can't load certificate pair %s/%s.key: %s", certPath, base, err)
+			continue
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Warnf("Can't parse certificate %s: %s", certPath, err)
+			continue
+		}
+		cert.Leaf = leaf
+
+		for _, name := range certNames(leaf) {
+			table[strings.ToLower(name)] = &cert
+		}
+	}
+
+	if len(table) == 0 {
+		return fmt.Errorf("no valid certificate pairs found in %s", m.certDir)
+	}
+
+	m.mu.Lock()
+	m.table = table
+	m.mu.Unlock()
+
+	return nil
+}
+
+func certNames(leaf *x509.Certificate) []string {
+	names := make([]string, 0, len(leaf.DNSNames)+1)
+	names = append(names, leaf.DNSNames...)
+
+	if len(leaf.Subject.CommonName) > 0 {
+		names = append(names, leaf.Subject.CommonName)
+	}
+
+	return names
+}
+
+// GetCertificate implements tls.Config.GetCertificate, selecting a
+// certificate by the ClientHello's SNI. When SNI is absent or matches no
+// loaded certificate, falls back to the self-signed default, if any, or to
+// an arbitrary loaded certificate.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if cert, ok := m.table[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+
+	if m.def != nil {
+		return m.def, nil
+	}
+
+	for _, cert := range m.table {
+		return cert, nil
+	}
+
+	return nil, fmt.Errorf("no certificate found for %q", hello.ServerName)
+}
+
+func generateSelfSigned(hosts []string) (*tls.Certificate, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "imgproxy development CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTpl, caTpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+
+	leafTpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(825 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     hosts,
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTpl, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(append(certPEM, caPEM...), keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf = leafCertOrNil(leafDER)
+
+	return &cert, nil
+}
+
+func leafCertOrNil(der []byte) *x509.Certificate {
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
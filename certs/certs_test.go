@@ -0,0 +1,145 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePair(t *testing.T, dir, name string, hosts []string) {
+	t.Helper()
+
+	cert, err := generateSelfSigned(hosts)
+	if err != nil {
+		t.Fatalf("generateSelfSigned: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o644); err != nil {
+		t.Fatalf("write cert: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o644); err != nil {
+		t.Fatalf("write key: %s", err)
+	}
+}
+
+func TestNewLoadsPairsBySAN(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "a", []string{"a.example.com"})
+	writePair(t, dir, "b", []string{"b.example.com"})
+
+	mgr, err := New(dir, dir)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		cert, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+		if err != nil {
+			t.Fatalf("GetCertificate(%s): %s", host, err)
+		}
+		if cert == nil {
+			t.Fatalf("GetCertificate(%s) returned nil", host)
+		}
+	}
+}
+
+func TestNewFailsOnEmptyDir(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := New(dir, dir); err == nil {
+		t.Fatal("expected an error when the cert directory has no valid pairs")
+	}
+}
+
+func TestReloadKeepsPreviousTableOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "a", []string{"a.example.com"})
+
+	mgr, err := New(dir, dir)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	// Corrupt the directory so a reload has nothing valid to load.
+	if err := os.Remove(filepath.Join(dir, "a.key")); err != nil {
+		t.Fatalf("remove key: %s", err)
+	}
+
+	if err := mgr.reload(); err == nil {
+		t.Fatal("expected reload to fail when no valid pairs remain")
+	}
+
+	// The previously loaded certificate must still be served.
+	cert, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if err != nil || cert == nil {
+		t.Fatalf("expected previous certificate to still be served after a failed reload, got cert=%v err=%v", cert, err)
+	}
+}
+
+func TestReloadPicksUpNewPairs(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "a", []string{"a.example.com"})
+
+	mgr, err := New(dir, dir)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	writePair(t, dir, "b", []string{"b.example.com"})
+
+	if err := mgr.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+
+	if _, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"}); err != nil {
+		t.Fatalf("expected b.example.com to be servable after reload: %s", err)
+	}
+}
+
+func TestGetCertificateFallsBackWhenSNIUnknown(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "a", []string{"a.example.com"})
+
+	mgr, err := New(dir, dir)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	cert, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+	if err != nil {
+		t.Fatalf("expected a fallback certificate, got error: %s", err)
+	}
+	if cert == nil {
+		t.Fatal("expected a fallback certificate, got nil")
+	}
+}
+
+func TestSelfSignedServesConfiguredHosts(t *testing.T) {
+	mgr, err := NewSelfSigned([]string{"dev.localhost"})
+	if err != nil {
+		t.Fatalf("NewSelfSigned: %s", err)
+	}
+
+	cert, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "dev.localhost"})
+	if err != nil || cert == nil {
+		t.Fatalf("expected the self-signed certificate to be served, got cert=%v err=%v", cert, err)
+	}
+
+	// Any SNI falls back to the single self-signed default.
+	cert, err = mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "someone-else.example.com"})
+	if err != nil || cert == nil {
+		t.Fatalf("expected the self-signed certificate as a fallback, got cert=%v err=%v", cert, err)
+	}
+}
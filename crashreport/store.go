@@ -0,0 +1,257 @@
+// Package crashreport decouples error-reporting latency (and availability)
+// from request latency. Panics are serialized to disk immediately and a
+// background goroutine drains them to the configured reporter with
+// exponential backoff, so a Sentry/Bugsnag outage can't slow down or drop
+// crash reports.
+package crashreport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scrubbedHeaders are stripped from the stored envelope entirely, rather
+// than attempting to redact just the secret portion of their value.
+var scrubbedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Envelope is a single panic, serialized to disk until it's been uploaded.
+type Envelope struct {
+	RequestID string      `json:"request_id"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header"`
+	Stack     string      `json:"stack"`
+	Error     string      `json:"error"`
+	StoredAt  time.Time   `json:"stored_at"`
+
+	attempts int
+}
+
+// NewEnvelope builds an Envelope from a request and a reported error,
+// scrubbing headers that could carry secrets.
+func NewEnvelope(reqID string, r *http.Request, stack string, err error) *Envelope {
+	header := r.Header.Clone()
+	for _, h := range scrubbedHeaders {
+		header.Del(h)
+	}
+
+	return &Envelope{
+		RequestID: reqID,
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		Header:    header,
+		Stack:     stack,
+		Error:     err.Error(),
+		StoredAt:  time.Now(),
+	}
+}
+
+// Uploader sends an envelope to the configured crash reporter. It should
+// return *UploadError when the reporter rejected the envelope outright
+// (e.g. a 4xx), and a plain error for anything that's worth retrying.
+type Uploader func(ctx context.Context, env *Envelope) error
+
+// UploadError is returned by an Uploader to report the reporter's HTTP
+// status code, so the Store can tell a permanent rejection (4xx) from a
+// transient failure worth retrying.
+type UploadError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *UploadError) Error() string { return e.Err.Error() }
+func (e *UploadError) Unwrap() error  { return e.Err }
+
+// Store is a disk-backed, size-capped, oldest-first-eviction queue of crash
+// envelopes awaiting upload.
+type Store struct {
+	dir     string
+	maxSize int64
+}
+
+// New creates a Store rooted at dir, capped at maxSizeMB megabytes of
+// queued envelopes (oldest evicted first once the cap is reached).
+func New(dir string, maxSizeMB int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create crash dir %s: %s", dir, err)
+	}
+
+	return &Store{dir: dir, maxSize: int64(maxSizeMB) << 20}, nil
+}
+
+// Enqueue writes env to disk and evicts the oldest queued envelopes, if any,
+// until the store is back under its size cap.
+func (s *Store) Enqueue(env *Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("can't marshal crash envelope: %s", err)
+	}
+
+	name := fmt.Sprintf("%d-%s.json", env.StoredAt.UnixNano(), env.RequestID)
+	path := filepath.Join(s.dir, name)
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("can't write crash envelope: %s", err)
+	}
+
+	s.evict()
+
+	return nil
+}
+
+// evict removes the oldest queued (non-quarantined) envelopes until the
+// store is under its size cap.
+func (s *Store) evict() {
+	if s.maxSize <= 0 {
+		return
+	}
+
+	type file struct {
+		path string
+		size int64
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	var files []file
+	var total int64
+
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".quarantined") {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		files = append(files, file{path: filepath.Join(s.dir, e.Name()), size: info.Size()})
+		total += info.Size()
+	}
+
+	if total <= s.maxSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+
+	for _, f := range files {
+		if total <= s.maxSize {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+		}
+	}
+}
+
+// Run drains queued envelopes to upload in a loop until ctx is canceled,
+// retrying transient failures with exponential backoff and quarantining
+// envelopes the reporter permanently rejects.
+func (s *Store) Run(ctx context.Context, upload Uploader) {
+	backoff := time.Second
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		drained, err := s.drainOnce(ctx, upload)
+		if err != nil {
+			backoff = nextBackoff(backoff)
+		} else if drained {
+			backoff = time.Second
+			continue
+		} else {
+			backoff = 2 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func nextBackoff(cur time.Duration) time.Duration {
+	next := cur * 2
+	if next > time.Minute {
+		next = time.Minute
+	}
+	// jitter to avoid every drain loop retrying in lockstep after an outage
+	return next/2 + time.Duration(rand.Int63n(int64(next/2)+1))
+}
+
+// drainOnce uploads the single oldest queued envelope, if any. The bool
+// return reports whether an envelope was found at all (regardless of
+// upload outcome), so Run can keep draining back-to-back without waiting
+// out the backoff between every file.
+func (s *Store) drainOnce(ctx context.Context, upload Uploader) (bool, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return false, err
+	}
+
+	var oldest string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if oldest == "" || e.Name() < oldest {
+			oldest = e.Name()
+		}
+	}
+
+	if oldest == "" {
+		return false, nil
+	}
+
+	path := filepath.Join(s.dir, oldest)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return true, err
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		// Can't parse our own envelope: quarantine rather than retry forever.
+		s.quarantine(path)
+		return true, nil
+	}
+
+	if err := upload(ctx, &env); err != nil {
+		if uerr, ok := err.(*UploadError); ok && uerr.StatusCode >= 400 && uerr.StatusCode < 500 {
+			log.Warnf("Crash reporter rejected %s, quarantining: %s", oldest, err)
+			s.quarantine(path)
+			return true, nil
+		}
+
+		return true, err
+	}
+
+	os.Remove(path)
+
+	return true, nil
+}
+
+func (s *Store) quarantine(path string) {
+	os.Rename(path, path+".quarantined")
+}
@@ -0,0 +1,205 @@
+package crashreport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func countFiles(t *testing.T, dir, suffix string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+
+	n := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), suffix) {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestEnvelope(t time.Time) *Envelope {
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/img.jpg", nil)
+	r.Header.Set("Authorization", "Bearer super-secret")
+
+	env := NewEnvelope("req-1", r, "goroutine 1 [running]:\nmain.panics()", errors.New("boom"))
+	env.StoredAt = t
+
+	return env
+}
+
+func TestNewEnvelopeScrubsSecretHeaders(t *testing.T) {
+	env := newTestEnvelope(time.Now())
+
+	if env.Header.Get("Authorization") != "" {
+		t.Fatalf("expected Authorization header to be scrubbed, got %q", env.Header.Get("Authorization"))
+	}
+}
+
+func TestEnqueueThenDrainUploadsAndUnlinks(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 10)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	if err := s.Enqueue(newTestEnvelope(time.Now())); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+
+	var uploaded *Envelope
+	drained, err := s.drainOnce(context.Background(), func(ctx context.Context, env *Envelope) error {
+		uploaded = env
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("drainOnce: %s", err)
+	}
+	if !drained {
+		t.Fatal("expected drainOnce to find the queued envelope")
+	}
+	if uploaded == nil || uploaded.RequestID != "req-1" {
+		t.Fatalf("expected the uploader to receive the queued envelope, got %v", uploaded)
+	}
+
+	if countFiles(t, dir, ".json") != 0 {
+		t.Fatal("expected the envelope file to be unlinked after a successful upload")
+	}
+}
+
+func TestDrainQuarantinesOn4xx(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 10)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	if err := s.Enqueue(newTestEnvelope(time.Now())); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+
+	_, err = s.drainOnce(context.Background(), func(ctx context.Context, env *Envelope) error {
+		return &UploadError{StatusCode: http.StatusBadRequest, Err: errors.New("rejected")}
+	})
+	if err != nil {
+		t.Fatalf("drainOnce should swallow a 4xx rejection, got %s", err)
+	}
+
+	if countFiles(t, dir, ".json") != 0 {
+		t.Fatal("expected the rejected envelope to no longer be queued as .json")
+	}
+	if countFiles(t, dir, ".quarantined") != 1 {
+		t.Fatal("expected the rejected envelope to be quarantined")
+	}
+}
+
+func TestDrainKeepsEnvelopeOnTransientError(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 10)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	if err := s.Enqueue(newTestEnvelope(time.Now())); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+
+	_, err = s.drainOnce(context.Background(), func(ctx context.Context, env *Envelope) error {
+		return errors.New("connection refused")
+	})
+	if err == nil {
+		t.Fatal("expected drainOnce to surface a transient upload error")
+	}
+
+	if countFiles(t, dir, ".json") != 1 {
+		t.Fatal("expected the envelope to remain queued for retry after a transient error")
+	}
+}
+
+func TestEvictRemovesOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 0)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	older := newTestEnvelope(time.Now().Add(-time.Minute))
+	older.RequestID = "older"
+	if err := s.Enqueue(older); err != nil {
+		t.Fatalf("Enqueue older: %s", err)
+	}
+
+	// Cap the store to roughly the size of a single envelope (plus a
+	// little slack), so enqueuing a second one forces the first to be
+	// evicted rather than both fitting comfortably.
+	firstEntries, err := os.ReadDir(dir)
+	if err != nil || len(firstEntries) != 1 {
+		t.Fatalf("expected exactly one queued file, got %v (err=%v)", firstEntries, err)
+	}
+	info, err := firstEntries[0].Info()
+	if err != nil {
+		t.Fatalf("Info: %s", err)
+	}
+	s.maxSize = info.Size() + info.Size()/2
+
+	newer := newTestEnvelope(time.Now())
+	newer.RequestID = "newer"
+	if err := s.Enqueue(newer); err != nil {
+		t.Fatalf("Enqueue newer: %s", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+
+	for _, e := range entries {
+		if strings.Contains(e.Name(), "older") {
+			t.Fatalf("expected the older envelope to have been evicted, found %s", e.Name())
+		}
+	}
+
+	found := false
+	for _, e := range entries {
+		if strings.Contains(e.Name(), "newer") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected the newer envelope to remain queued")
+	}
+}
+
+func TestRunStopsWhenContextCanceled(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 10)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		s.Run(ctx, func(ctx context.Context, env *Envelope) error { return nil })
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return once its context was canceled")
+	}
+}
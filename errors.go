@@ -11,7 +11,10 @@ type (
 	ResponseWriteError   struct{ error }
 	InvalidURLError      string
 	TooManyRequestsError struct{}
+	InFlightTimeoutError struct{}
 	InvalidSecretError   struct{}
+	TokenExpiredError    struct{}
+	JWTScopeError        struct{ error }
 )
 
 func newResponseWriteError(cause error) *ierrors.Error {
@@ -54,6 +57,22 @@ func newTooManyRequestsError() error {
 
 func (e TooManyRequestsError) Error() string { return "Too many requests" }
 
+// newInFlightTimeoutError reports that a request timed out waiting for an
+// in-flight slot. 503, not TooManyRequestsError's 429: this is the server
+// signaling transient overload, which clients/load balancers should retry
+// rather than back off from as a rate limit.
+func newInFlightTimeoutError() error {
+	return ierrors.Wrap(
+		InFlightTimeoutError{},
+		1,
+		ierrors.WithStatusCode(http.StatusServiceUnavailable),
+		ierrors.WithPublicMessage("Service is overloaded"),
+		ierrors.WithShouldReport(false),
+	)
+}
+
+func (e InFlightTimeoutError) Error() string { return "Timed out waiting for an in-flight slot" }
+
 func newInvalidSecretError() error {
 	return ierrors.Wrap(
 		InvalidSecretError{},
@@ -65,3 +84,31 @@ func newInvalidSecretError() error {
 }
 
 func (e InvalidSecretError) Error() string { return "Invalid secret" }
+
+func newTokenExpiredError() error {
+	return ierrors.Wrap(
+		TokenExpiredError{},
+		1,
+		ierrors.WithStatusCode(http.StatusUnauthorized),
+		ierrors.WithPublicMessage("Forbidden"),
+		ierrors.WithShouldReport(false),
+	)
+}
+
+func (e TokenExpiredError) Error() string { return "Token is expired" }
+
+func newJWTScopeError(cause error) *ierrors.Error {
+	return ierrors.Wrap(
+		JWTScopeError{cause},
+		1,
+		ierrors.WithStatusCode(http.StatusForbidden),
+		ierrors.WithPublicMessage("Forbidden"),
+		ierrors.WithShouldReport(false),
+	)
+}
+
+func (e JWTScopeError) Error() string {
+	return fmt.Sprintf("Request is outside of token scope: %s", e.error)
+}
+
+func (e JWTScopeError) Unwrap() error { return e.error }
@@ -0,0 +1,302 @@
+// Package httpcache implements a bounded, in-process cache for fully
+// rendered processing responses. It exists to avoid redundant libvips work
+// for hot URLs sitting behind a CDN cold-start or receiving repeated
+// identical requests.
+package httpcache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/imgproxy/imgproxy/v3/metrics"
+)
+
+// entry is a single cached response.
+type entry struct {
+	key          string
+	body         []byte
+	statusCode   int
+	contentType  string
+	cacheControl string
+	etag         string
+	storedAt     time.Time
+	ttl          time.Duration
+	staleGrace   time.Duration
+}
+
+func (e *entry) fresh() bool { return time.Since(e.storedAt) < e.ttl }
+
+func (e *entry) usable() bool { return time.Since(e.storedAt) < e.ttl+e.staleGrace }
+
+// Cache is a size-bounded LRU of rendered responses with stale-while-revalidate
+// semantics and singleflight-deduplicated background revalidation.
+type Cache struct {
+	maxTTL     time.Duration
+	staleGrace time.Duration
+
+	mu      sync.Mutex
+	ll      *list.List
+	items   map[string]*list.Element
+	size    int64
+	maxSize int64
+
+	// renderGroup and revalidateGroup are separate so a genuine cache miss
+	// never joins the flight of a background revalidation for the same key
+	// (or vice versa): the two callers want different return values from
+	// group.Do, and singleflight shares whichever call registered first
+	// across every caller waiting on that key.
+	renderGroup     singleflight.Group
+	revalidateGroup singleflight.Group
+}
+
+// New creates a Cache bounded to maxSizeMB megabytes. maxTTL clamps whatever
+// TTL is derived from a response's Cache-Control: max-age. staleGrace is how
+// long past TTL a stale entry may still be served while a single background
+// revalidation is in flight.
+func New(maxSizeMB int, maxTTL, staleGrace time.Duration) *Cache {
+	return &Cache{
+		maxSize:    int64(maxSizeMB) << 20,
+		maxTTL:     maxTTL,
+		staleGrace: staleGrace,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Key canonicalizes a processing request (signature + options + source URL,
+// as encoded in the request path) into a cache key.
+func Key(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path))
+	return hex.EncodeToString(sum[:])
+}
+
+// Serve looks up key in the cache and either serves a fresh/stale hit
+// directly, or calls next to render the response, capturing it into the
+// cache as it's written. next must write the full response to rw.
+func (c *Cache) Serve(rw http.ResponseWriter, r *http.Request, key string, next func(http.ResponseWriter, *http.Request)) {
+	if r.Method != http.MethodGet {
+		next(rw, r)
+		return
+	}
+
+	if e, ok := c.get(key); ok {
+		if inm := r.Header.Get("If-None-Match"); len(inm) > 0 && len(e.etag) > 0 && inm == e.etag {
+			metrics.IncResponseCache("hit")
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if e.fresh() {
+			metrics.IncResponseCache("hit")
+			writeEntry(rw, e)
+			return
+		}
+
+		if e.usable() {
+			metrics.IncResponseCache("stale")
+			rw.Header().Set("Warning", `110 imgproxy "Response is Stale"`)
+			writeEntry(rw, e)
+			c.revalidate(key, r, next)
+			return
+		}
+	}
+
+	metrics.IncResponseCache("miss")
+	c.renderAndStore(key, rw, r, next)
+}
+
+// revalidate refreshes a stale entry in the background, deduplicating
+// concurrent revalidations of the same key. The request is detached from
+// the triggering request's context: that context is canceled as soon as
+// Serve's caller returns (net/http cancels a server request's context right
+// after ServeHTTP returns), which would otherwise abort the revalidation's
+// origin fetch before it ever gets going.
+func (c *Cache) revalidate(key string, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	detached := r.WithContext(context.WithoutCancel(r.Context()))
+
+	go func() {
+		defer func() {
+			if rerr := recover(); rerr != nil {
+				log.Warnf("httpcache: background revalidation of %s panicked: %v", key, rerr)
+			}
+		}()
+
+		c.revalidateGroup.Do(key, func() (interface{}, error) {
+			rec := newRecorder()
+			next(rec, detached)
+			c.store(key, rec)
+			metrics.IncResponseCache("revalidate")
+			return nil, nil
+		})
+	}()
+}
+
+func (c *Cache) renderAndStore(key string, rw http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	v, _, _ := c.renderGroup.Do(key, func() (interface{}, error) {
+		rec := newRecorder()
+		next(rec, r)
+		c.store(key, rec)
+		return rec, nil
+	})
+
+	rec := v.(*responseRecorder)
+	for name, values := range rec.header {
+		for _, value := range values {
+			rw.Header().Add(name, value)
+		}
+	}
+	rw.WriteHeader(rec.statusCode)
+	rw.Write(rec.body.Bytes())
+}
+
+func (c *Cache) store(key string, rec *responseRecorder) {
+	if rec.statusCode != http.StatusOK {
+		return
+	}
+
+	ttl := maxAge(rec.header.Get("Cache-Control"))
+	if ttl <= 0 {
+		return
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	e := &entry{
+		key:          key,
+		body:         rec.body.Bytes(),
+		statusCode:   rec.statusCode,
+		contentType:  rec.header.Get("Content-Type"),
+		cacheControl: rec.header.Get("Cache-Control"),
+		etag:         rec.header.Get("ETag"),
+		storedAt:     time.Now(),
+		ttl:          ttl,
+		staleGrace:   c.staleGrace,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.size -= int64(len(el.Value.(*entry).body))
+		el.Value = e
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(e)
+	}
+	c.size += int64(len(e.body))
+
+	for c.size > c.maxSize && c.ll.Len() > 0 {
+		back := c.ll.Back()
+		if back == nil {
+			break
+		}
+		c.ll.Remove(back)
+		old := back.Value.(*entry)
+		delete(c.items, old.key)
+		c.size -= int64(len(old.body))
+	}
+}
+
+func (c *Cache) get(key string) (*entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return el.Value.(*entry), true
+}
+
+func writeEntry(rw http.ResponseWriter, e *entry) {
+	if len(e.contentType) > 0 {
+		rw.Header().Set("Content-Type", e.contentType)
+	}
+	if len(e.cacheControl) > 0 {
+		rw.Header().Set("Cache-Control", e.cacheControl)
+	}
+	if len(e.etag) > 0 {
+		rw.Header().Set("ETag", e.etag)
+	}
+	rw.WriteHeader(e.statusCode)
+	rw.Write(e.body)
+}
+
+// maxAge extracts max-age from a Cache-Control header value. Returns 0 if
+// absent, unparsable, or the response isn't cacheable (no-store/private).
+func maxAge(cc string) time.Duration {
+	if len(cc) == 0 {
+		return 0
+	}
+
+	var age time.Duration
+
+	for _, part := range strings.Split(cc, ",") {
+		part = strings.TrimSpace(part)
+		if strings.EqualFold(part, "no-store") || strings.EqualFold(part, "private") {
+			return 0
+		}
+
+		if age > 0 || !strings.HasPrefix(strings.ToLower(part), "max-age=") {
+			continue
+		}
+
+		secs, err := strconv.Atoi(part[len("max-age="):])
+		if err != nil || secs <= 0 {
+			return 0
+		}
+
+		age = time.Duration(secs) * time.Second
+	}
+
+	return age
+}
+
+// responseRecorder buffers a response so it can be cached before being
+// flushed to the real ResponseWriter.
+type responseRecorder struct {
+	header     http.Header
+	statusCode int
+	body       *bytes.Buffer
+	wroteHead  bool
+}
+
+func newRecorder() *responseRecorder {
+	return &responseRecorder{
+		header:     make(http.Header),
+		statusCode: http.StatusOK,
+		body:       &bytes.Buffer{},
+	}
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wroteHead {
+		return
+	}
+	r.statusCode = status
+	r.wroteHead = true
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if !r.wroteHead {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.body.Write(p)
+}
@@ -0,0 +1,201 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":                           0,
+		"max-age=60":                 60 * time.Second,
+		"public, max-age=30":         30 * time.Second,
+		"no-store":                   0,
+		"private, max-age=30":        0,
+		"max-age=0":                  0,
+		"max-age=not-a-number":       0,
+		"no-cache, max-age=5, other": 5 * time.Second,
+	}
+
+	for cc, want := range cases {
+		if got := maxAge(cc); got != want {
+			t.Errorf("maxAge(%q) = %s, want %s", cc, got, want)
+		}
+	}
+}
+
+func TestKeyStableForSameRequest(t *testing.T) {
+	r1 := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/aHR0cHM6Ly9leGFtcGxlLmNvbQ.jpg", nil)
+	r2 := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/aHR0cHM6Ly9leGFtcGxlLmNvbQ.jpg", nil)
+	r3 := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:200:200/aHR0cHM6Ly9leGFtcGxlLmNvbQ.jpg", nil)
+
+	if Key(r1) != Key(r2) {
+		t.Fatal("expected the same path to produce the same cache key")
+	}
+	if Key(r1) == Key(r3) {
+		t.Fatal("expected different paths to produce different cache keys")
+	}
+}
+
+func okHandler(body string, maxAgeSeconds int) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "image/jpeg")
+		rw.Header().Set("Cache-Control", httpCacheControl(maxAgeSeconds))
+		rw.Header().Set("ETag", `"etag-value"`)
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(body))
+	}
+}
+
+func httpCacheControl(maxAgeSeconds int) string {
+	if maxAgeSeconds <= 0 {
+		return "no-store"
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAgeSeconds)
+}
+
+func TestServeMissThenHit(t *testing.T) {
+	c := New(10, time.Minute, time.Minute)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		okHandler("body", 60)(rw, r)
+	}
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil)
+		rw := httptest.NewRecorder()
+		c.Serve(rw, r, "key-a", next)
+
+		if rw.Body.String() != "body" {
+			t.Fatalf("unexpected body: %q", rw.Body.String())
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected next to run once (miss) and be served from cache on the second call, ran %d times", calls)
+	}
+}
+
+func TestServeReturns304OnMatchingETag(t *testing.T) {
+	c := New(10, time.Minute, time.Minute)
+
+	next := okHandler("body", 60)
+
+	r := httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil)
+	c.Serve(httptest.NewRecorder(), r, "key-a", next)
+
+	r2 := httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil)
+	r2.Header.Set("If-None-Match", `"etag-value"`)
+	rw2 := httptest.NewRecorder()
+	c.Serve(rw2, r2, "key-a", next)
+
+	if rw2.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rw2.Code)
+	}
+}
+
+func TestServeRevalidatesStaleEntryInBackground(t *testing.T) {
+	c := New(10, time.Minute, time.Minute)
+
+	var calls int32
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		okHandler("body", 60)(rw, r)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil)
+	c.Serve(httptest.NewRecorder(), r, "key-a", next)
+
+	// Force the entry stale without waiting out a real TTL.
+	c.mu.Lock()
+	el := c.items["key-a"]
+	el.Value.(*entry).storedAt = time.Now().Add(-90 * time.Second)
+	c.mu.Unlock()
+
+	r2 := httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil)
+	rw2 := httptest.NewRecorder()
+	c.Serve(rw2, r2, "key-a", next)
+
+	if rw2.Header().Get("Warning") == "" {
+		t.Fatal("expected a stale hit to set the Warning header")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected background revalidation to call next once more, calls=%d", calls)
+	}
+}
+
+func TestMissDuringRevalidationDoesNotJoinItsFlight(t *testing.T) {
+	c := New(10, time.Minute, time.Minute)
+
+	next := okHandler("body", 60)
+	r := httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil)
+	c.Serve(httptest.NewRecorder(), r, "key-a", next)
+
+	// Force the entry stale, then make a stale hit kick off a background
+	// revalidation on key-a, blocking inside it.
+	c.mu.Lock()
+	el := c.items["key-a"]
+	el.Value.(*entry).storedAt = time.Now().Add(-90 * time.Second)
+	c.mu.Unlock()
+
+	unblock := make(chan struct{})
+	slowNext := func(rw http.ResponseWriter, r *http.Request) {
+		<-unblock
+		okHandler("body", 60)(rw, r)
+	}
+
+	rStale := httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil)
+	c.Serve(httptest.NewRecorder(), rStale, "key-a", slowNext)
+
+	// A genuine miss on the same key (e.g. after eviction) must not panic by
+	// joining the in-flight revalidation's singleflight call, which returns
+	// (nil, nil) rather than a *responseRecorder.
+	c.mu.Lock()
+	delete(c.items, "key-a")
+	c.ll.Init()
+	c.mu.Unlock()
+
+	rw := httptest.NewRecorder()
+	c.Serve(rw, httptest.NewRequest(http.MethodGet, "/a/b/c.jpg", nil), "key-a", okHandler("body", 60))
+
+	if rw.Body.String() != "body" {
+		t.Fatalf("unexpected body from concurrent miss: %q", rw.Body.String())
+	}
+
+	close(unblock)
+}
+
+func TestEvictsOldestOverSizeCap(t *testing.T) {
+	// maxSizeMB=0 with a manual maxSize below is awkward, so build the cache
+	// then shrink its cap directly to exercise eviction deterministically.
+	c := New(1, time.Minute, time.Minute)
+	c.maxSize = 10
+
+	next := okHandler("0123456789", 60)
+
+	r1 := httptest.NewRequest(http.MethodGet, "/a.jpg", nil)
+	c.Serve(httptest.NewRecorder(), r1, "key-1", next)
+
+	r2 := httptest.NewRequest(http.MethodGet, "/b.jpg", nil)
+	c.Serve(httptest.NewRecorder(), r2, "key-2", next)
+
+	if _, ok := c.get("key-1"); ok {
+		t.Fatal("expected the oldest entry to have been evicted once over the size cap")
+	}
+	if _, ok := c.get("key-2"); !ok {
+		t.Fatal("expected the most recently stored entry to still be cached")
+	}
+}
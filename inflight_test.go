@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInFlightLimiterNilWhenUnlimited(t *testing.T) {
+	l := newInFlightLimiter("test", 0)
+	if l != nil {
+		t.Fatal("expected a non-positive limit to produce a nil (no-op) limiter")
+	}
+
+	if !l.acquire() {
+		t.Fatal("expected a nil limiter's acquire to always succeed")
+	}
+	l.release()
+}
+
+func TestInFlightLimiterAcquireRelease(t *testing.T) {
+	l := newInFlightLimiter("test", 1)
+
+	if !l.acquire() {
+		t.Fatal("expected the first acquire to succeed")
+	}
+
+	l.queueTimeout = 10 * time.Millisecond
+	if l.acquire() {
+		t.Fatal("expected a second acquire to fail while the only slot is held")
+	}
+
+	l.release()
+
+	l.queueTimeout = 0
+	if !l.acquire() {
+		t.Fatal("expected acquire to succeed once the slot was released")
+	}
+}
+
+func TestInFlightLimiterAcquireWaitsForQueueTimeout(t *testing.T) {
+	l := newInFlightLimiter("test", 1)
+	l.queueTimeout = 50 * time.Millisecond
+
+	if !l.acquire() {
+		t.Fatal("expected the first acquire to succeed")
+	}
+
+	start := time.Now()
+	if l.acquire() {
+		t.Fatal("expected acquire to fail once the queue timeout elapses")
+	}
+	if elapsed := time.Since(start); elapsed < l.queueTimeout {
+		t.Fatalf("expected acquire to wait out the queue timeout, returned after %s", elapsed)
+	}
+}
+
+func TestWithMaxInFlightReturns503WithRetryAfter(t *testing.T) {
+	l := newInFlightLimiter("test", 1)
+	l.queueTimeout = 10 * time.Millisecond
+
+	if !l.acquire() {
+		t.Fatal("expected to hold the only slot")
+	}
+
+	h := withMaxInFlight(l, func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not run when the in-flight slot can't be acquired")
+	})
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	func() {
+		defer func() {
+			rerr := recover()
+			if rerr == nil {
+				t.Fatal("expected withMaxInFlight to panic with an error on timeout")
+			}
+			err, ok := rerr.(error)
+			if !ok {
+				t.Fatalf("expected a panic value implementing error, got %T", rerr)
+			}
+			sc, ok := err.(interface{ StatusCode() int })
+			if !ok {
+				t.Fatalf("expected the panic error to carry a status code, got %T", err)
+			}
+			if sc.StatusCode() != http.StatusServiceUnavailable {
+				t.Fatalf("expected a 503 status code, got %d", sc.StatusCode())
+			}
+		}()
+		h("req-1", rw, r)
+	}()
+
+	if rw.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header to be set before panicking")
+	}
+}
+
+func TestWithMaxInFlightNilLimiterIsNoOp(t *testing.T) {
+	called := false
+	h := withMaxInFlight(nil, func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	h("req-1", httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !called {
+		t.Fatal("expected the wrapped handler to run when no limiter is configured")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/imgproxy/imgproxy/v3/config"
+	"github.com/imgproxy/imgproxy/v3/errorreport"
+	"github.com/imgproxy/imgproxy/v3/router"
+)
+
+// dimensionOptions maps a processing option name to the argument indexes
+// (0-based, after the option name) that carry a width/height the token's
+// max_w/max_h should be checked against.
+var dimensionOptions = map[string][2]int{
+	"width":  {0, -1},
+	"w":      {0, -1},
+	"height": {-1, 0},
+	"h":      {-1, 0},
+	"size":   {0, 1},
+	"s":      {0, 1},
+	"resize": {1, 2},
+	"rs":     {1, 2},
+}
+
+// jwtClaims are the standard JWT claims plus the custom claims a token may
+// use to constrain what it's allowed to request.
+type jwtClaims struct {
+	jwt.RegisteredClaims
+
+	SrcPrefix      string   `json:"src_prefix,omitempty"`
+	MaxWidth       int      `json:"max_w,omitempty"`
+	MaxHeight      int      `json:"max_h,omitempty"`
+	AllowedOptions []string `json:"allowed_options,omitempty"`
+	RateLimitKey   string   `json:"rate_limit_key,omitempty"`
+}
+
+type jwtClaimsCtxKey struct{}
+
+// ClaimsFromContext returns the JWT claims validated for this request, if
+// JWT auth is enabled and the request carried a valid token.
+func ClaimsFromContext(ctx context.Context) (*jwtClaims, bool) {
+	claims, ok := ctx.Value(jwtClaimsCtxKey{}).(*jwtClaims)
+	return claims, ok
+}
+
+// jwtKeyFunc resolves the key used to verify IMGPROXY_JWT_PUBLIC_KEY:
+// an RSA or ECDSA PEM public key for RS256/ES256, or a raw HS256 secret.
+func jwtKeyFunc(t *jwt.Token) (interface{}, error) {
+	key := []byte(config.JWTPublicKey)
+
+	if block, _ := pem.Decode(key); block != nil {
+		if pub, err := jwt.ParseRSAPublicKeyFromPEM(key); err == nil {
+			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+			}
+			return pub, nil
+		}
+
+		if pub, err := jwt.ParseECPublicKeyFromPEM(key); err == nil {
+			if _, ok := t.Method.(*jwt.SigningMethodECDSA); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+			}
+			return pub, nil
+		}
+
+		return nil, fmt.Errorf("can't parse IMGPROXY_JWT_PUBLIC_KEY as an RSA or EC public key")
+	}
+
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+
+	return key, nil
+}
+
+// withJWT verifies the Authorization: Bearer <token> header against
+// IMGPROXY_JWT_PUBLIC_KEY, checking exp/nbf/iss/aud, enforces the token's
+// src_prefix/max_w/max_h/allowed_options scope against the requested
+// processing URL, and stashes the parsed claims in the request context so
+// handleProcessing can read RateLimitKey and the rest.
+func withJWT(h router.RouteHandler) router.RouteHandler {
+	return func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if len(token) == 0 || token == auth {
+			panic(newInvalidSecretError())
+		}
+
+		parserOpts := []jwt.ParserOption{
+			jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}),
+		}
+		if len(config.JWTIssuer) > 0 {
+			parserOpts = append(parserOpts, jwt.WithIssuer(config.JWTIssuer))
+		}
+		if len(config.JWTAudience) > 0 {
+			parserOpts = append(parserOpts, jwt.WithAudience(config.JWTAudience))
+		}
+
+		claims := &jwtClaims{}
+
+		if _, err := jwt.ParseWithClaims(token, claims, jwtKeyFunc, parserOpts...); err != nil {
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				panic(newTokenExpiredError())
+			}
+			panic(newInvalidSecretError())
+		}
+
+		if err := enforceJWTScope(claims, r); err != nil {
+			panic(newJWTScopeError(err))
+		}
+
+		errorreport.SetMetadata(r, "JWT Subject", claims.Subject)
+
+		ctx := context.WithValue(r.Context(), jwtClaimsCtxKey{}, claims)
+		h(reqID, rw, r.WithContext(ctx))
+	}
+}
+
+// enforceJWTScope checks the requested processing URL against the token's
+// src_prefix, max_w/max_h, and allowed_options claims. The advanced form is
+// /<signature>/<options>/<encoded source url>, so the source is the last
+// path segment and everything in between is a colon-separated option; the
+// plain form is /<signature>/plain/<raw source url>, which carries no
+// processing options and whose source may itself contain "/".
+func enforceJWTScope(claims *jwtClaims, r *http.Request) error {
+	if len(claims.SrcPrefix) == 0 && claims.MaxWidth == 0 && claims.MaxHeight == 0 && len(claims.AllowedOptions) == 0 {
+		return nil
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 {
+		return nil
+	}
+
+	if segments[1] == "plain" {
+		return enforcePlainJWTScope(claims, segments[2:])
+	}
+
+	optSegments, srcSegment := segments[:len(segments)-1], segments[len(segments)-1]
+
+	if len(claims.SrcPrefix) > 0 {
+		src, err := decodeSourceSegment(srcSegment)
+		if err != nil || !strings.HasPrefix(src, claims.SrcPrefix) {
+			return fmt.Errorf("source URL is not allowed by token")
+		}
+	}
+
+	allowed := make(map[string]bool, len(claims.AllowedOptions))
+	for _, o := range claims.AllowedOptions {
+		allowed[o] = true
+	}
+
+	// The first segment is the signature, not an option.
+	for _, seg := range optSegments[1:] {
+		parts := strings.Split(seg, ":")
+		name := parts[0]
+
+		if len(claims.AllowedOptions) > 0 && !allowed[name] {
+			return fmt.Errorf("processing option %q is not allowed by token", name)
+		}
+
+		if err := enforceDimensionClaim(claims, name, parts[1:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enforcePlainJWTScope checks a plain-form source URL (no processing
+// options to enforce allowed_options/max_w/max_h against) against the
+// token's src_prefix.
+func enforcePlainJWTScope(claims *jwtClaims, srcSegments []string) error {
+	if len(claims.SrcPrefix) == 0 {
+		return nil
+	}
+
+	if len(srcSegments) == 0 {
+		return fmt.Errorf("source URL is not allowed by token")
+	}
+
+	src := decodePlainSourceSegment(strings.Join(srcSegments, "/"))
+	if !strings.HasPrefix(src, claims.SrcPrefix) {
+		return fmt.Errorf("source URL is not allowed by token")
+	}
+
+	return nil
+}
+
+// decodePlainSourceSegment strips a trailing "@extension" (if any) from a
+// plain-form source URL.
+func decodePlainSourceSegment(segment string) string {
+	if i := strings.LastIndex(segment, "@"); i > 0 {
+		segment = segment[:i]
+	}
+	return segment
+}
+
+func enforceDimensionClaim(claims *jwtClaims, option string, args []string) error {
+	idx, ok := dimensionOptions[option]
+	if !ok {
+		return nil
+	}
+
+	checkArg := func(i, max int) error {
+		if i < 0 || max <= 0 || i >= len(args) {
+			return nil
+		}
+
+		v, err := strconv.Atoi(args[i])
+		if err != nil || v <= 0 {
+			return nil
+		}
+
+		if v > max {
+			return fmt.Errorf("option %q requests a dimension larger than the token allows", option)
+		}
+
+		return nil
+	}
+
+	if err := checkArg(idx[0], claims.MaxWidth); err != nil {
+		return err
+	}
+
+	return checkArg(idx[1], claims.MaxHeight)
+}
+
+// decodeSourceSegment strips a trailing file extension (if any) and
+// base64url-decodes the source URL segment.
+func decodeSourceSegment(segment string) (string, error) {
+	if i := strings.LastIndex(segment, "."); i > 0 {
+		segment = segment[:i]
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// withAuth picks JWT verification when IMGPROXY_JWT_PUBLIC_KEY is
+// configured, falling back to the constant-time shared secret check
+// otherwise.
+func withAuth(h router.RouteHandler) router.RouteHandler {
+	if len(config.JWTPublicKey) > 0 {
+		return withJWT(h)
+	}
+
+	return withSecret(h)
+}
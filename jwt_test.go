@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/imgproxy/imgproxy/v3/config"
+)
+
+func encodeAdvancedSource(src, ext string) string {
+	seg := base64.RawURLEncoding.EncodeToString([]byte(src))
+	if len(ext) > 0 {
+		seg += "." + ext
+	}
+	return seg
+}
+
+func TestEnforceJWTScopeAdvancedFormSrcPrefix(t *testing.T) {
+	claims := &jwtClaims{SrcPrefix: "https://allowed.example.com/"}
+
+	allowed := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/"+encodeAdvancedSource("https://allowed.example.com/a.jpg", "jpg"), nil)
+	if err := enforceJWTScope(claims, allowed); err != nil {
+		t.Fatalf("expected a source matching src_prefix to be allowed, got: %s", err)
+	}
+
+	denied := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/"+encodeAdvancedSource("https://other.example.com/a.jpg", "jpg"), nil)
+	if err := enforceJWTScope(claims, denied); err == nil {
+		t.Fatal("expected a source outside src_prefix to be denied")
+	}
+}
+
+func TestEnforceJWTScopeAdvancedFormAllowedOptions(t *testing.T) {
+	claims := &jwtClaims{AllowedOptions: []string{"resize"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/sig/blur:5/"+encodeAdvancedSource("https://example.com/a.jpg", "jpg"), nil)
+	if err := enforceJWTScope(claims, r); err == nil {
+		t.Fatal("expected an option outside allowed_options to be denied")
+	}
+
+	r2 := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/"+encodeAdvancedSource("https://example.com/a.jpg", "jpg"), nil)
+	if err := enforceJWTScope(claims, r2); err != nil {
+		t.Fatalf("expected an allowed option to pass, got: %s", err)
+	}
+}
+
+func TestEnforceJWTScopeAdvancedFormMaxDimension(t *testing.T) {
+	claims := &jwtClaims{MaxWidth: 100}
+
+	tooWide := httptest.NewRequest(http.MethodGet, "/sig/width:200/"+encodeAdvancedSource("https://example.com/a.jpg", "jpg"), nil)
+	if err := enforceJWTScope(claims, tooWide); err == nil {
+		t.Fatal("expected a width exceeding max_w to be denied")
+	}
+
+	ok := httptest.NewRequest(http.MethodGet, "/sig/width:50/"+encodeAdvancedSource("https://example.com/a.jpg", "jpg"), nil)
+	if err := enforceJWTScope(claims, ok); err != nil {
+		t.Fatalf("expected a width within max_w to pass, got: %s", err)
+	}
+}
+
+func TestEnforceJWTScopePlainForm(t *testing.T) {
+	claims := &jwtClaims{SrcPrefix: "https://allowed.example.com/"}
+
+	allowed := httptest.NewRequest(http.MethodGet, "/sig/plain/https://allowed.example.com/nested/a.jpg@png", nil)
+	if err := enforceJWTScope(claims, allowed); err != nil {
+		t.Fatalf("expected a plain-form source matching src_prefix to be allowed, got: %s", err)
+	}
+
+	denied := httptest.NewRequest(http.MethodGet, "/sig/plain/https://other.example.com/a.jpg", nil)
+	if err := enforceJWTScope(claims, denied); err == nil {
+		t.Fatal("expected a plain-form source outside src_prefix to be denied")
+	}
+}
+
+func TestEnforceJWTScopePlainFormIgnoresAllowedOptions(t *testing.T) {
+	// A plain-form request has no processing options to check against
+	// allowed_options, so it must not be rejected for lacking any.
+	claims := &jwtClaims{AllowedOptions: []string{"resize"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/sig/plain/https://example.com/a.jpg", nil)
+	if err := enforceJWTScope(claims, r); err != nil {
+		t.Fatalf("expected a plain-form request to bypass allowed_options, got: %s", err)
+	}
+}
+
+func TestEnforceDimensionClaimRejectsOversizedDimension(t *testing.T) {
+	claims := &jwtClaims{MaxWidth: 100, MaxHeight: 50}
+
+	if err := enforceDimensionClaim(claims, "resize", []string{"fit", "200", "10"}); err == nil {
+		t.Fatal("expected resize's width arg to be checked against max_w")
+	}
+	if err := enforceDimensionClaim(claims, "resize", []string{"fit", "10", "200"}); err == nil {
+		t.Fatal("expected resize's height arg to be checked against max_h")
+	}
+	if err := enforceDimensionClaim(claims, "resize", []string{"fit", "10", "10"}); err != nil {
+		t.Fatalf("expected dimensions within bounds to pass, got: %s", err)
+	}
+	if err := enforceDimensionClaim(claims, "gravity", []string{"ce"}); err != nil {
+		t.Fatalf("expected an option with no dimension mapping to be ignored, got: %s", err)
+	}
+}
+
+func pemEncodeRSAPublic(t *testing.T, pub *rsa.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func pemEncodeECPublic(t *testing.T, pub *ecdsa.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestJWTKeyFuncHMAC(t *testing.T) {
+	config.JWTPublicKey = "shared-secret"
+	defer func() { config.JWTPublicKey = "" }()
+
+	key, err := jwtKeyFunc(&jwt.Token{Method: jwt.SigningMethodHS256, Header: map[string]interface{}{"alg": "HS256"}})
+	if err != nil {
+		t.Fatalf("jwtKeyFunc: %s", err)
+	}
+	if string(key.([]byte)) != "shared-secret" {
+		t.Fatalf("expected the raw secret to be returned, got %v", key)
+	}
+
+	if _, err := jwtKeyFunc(&jwt.Token{Method: jwt.SigningMethodRS256, Header: map[string]interface{}{"alg": "RS256"}}); err == nil {
+		t.Fatal("expected an RSA signing method to be rejected against a plain HS256 secret")
+	}
+}
+
+func TestJWTKeyFuncRSA(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	config.JWTPublicKey = string(pemEncodeRSAPublic(t, &priv.PublicKey))
+	defer func() { config.JWTPublicKey = "" }()
+
+	if _, err := jwtKeyFunc(&jwt.Token{Method: jwt.SigningMethodRS256, Header: map[string]interface{}{"alg": "RS256"}}); err != nil {
+		t.Fatalf("jwtKeyFunc: %s", err)
+	}
+
+	if _, err := jwtKeyFunc(&jwt.Token{Method: jwt.SigningMethodHS256, Header: map[string]interface{}{"alg": "HS256"}}); err == nil {
+		t.Fatal("expected an HMAC signing method to be rejected against an RSA public key")
+	}
+}
+
+func TestJWTKeyFuncES256(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	config.JWTPublicKey = string(pemEncodeECPublic(t, &priv.PublicKey))
+	defer func() { config.JWTPublicKey = "" }()
+
+	if _, err := jwtKeyFunc(&jwt.Token{Method: jwt.SigningMethodES256, Header: map[string]interface{}{"alg": "ES256"}}); err != nil {
+		t.Fatalf("jwtKeyFunc: %s", err)
+	}
+}
+
+func signHS256(t *testing.T, secret string, claims *jwtClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	s, err := tok.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("SignedString: %s", err)
+	}
+	return s
+}
+
+func TestWithJWTRejectsExpiredToken(t *testing.T) {
+	config.JWTPublicKey = "shared-secret"
+	defer func() { config.JWTPublicKey = "" }()
+
+	claims := &jwtClaims{RegisteredClaims: jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+	}}
+	token := signHS256(t, "shared-secret", claims)
+
+	r := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/"+encodeAdvancedSource("https://example.com/a.jpg", "jpg"), nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	defer func() {
+		rerr := recover()
+		if rerr == nil {
+			t.Fatal("expected withJWT to panic on an expired token")
+		}
+		err, ok := rerr.(interface{ StatusCode() int })
+		if !ok || err.StatusCode() != http.StatusUnauthorized {
+			t.Fatalf("expected a 401 panic, got %#v", rerr)
+		}
+	}()
+
+	withJWT(func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not run for an expired token")
+	})("req-1", httptest.NewRecorder(), r)
+}
+
+func TestWithJWTRejectsOutOfScopeRequest(t *testing.T) {
+	config.JWTPublicKey = "shared-secret"
+	defer func() { config.JWTPublicKey = "" }()
+
+	claims := &jwtClaims{SrcPrefix: "https://allowed.example.com/"}
+	token := signHS256(t, "shared-secret", claims)
+
+	r := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/"+encodeAdvancedSource("https://denied.example.com/a.jpg", "jpg"), nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	defer func() {
+		rerr := recover()
+		if rerr == nil {
+			t.Fatal("expected withJWT to panic when the request is outside the token's scope")
+		}
+		err, ok := rerr.(interface{ StatusCode() int })
+		if !ok || err.StatusCode() != http.StatusForbidden {
+			t.Fatalf("expected a 403 panic, got %#v", rerr)
+		}
+	}()
+
+	withJWT(func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not run for an out-of-scope request")
+	})("req-1", httptest.NewRecorder(), r)
+}
+
+func TestWithJWTAcceptsValidTokenInScope(t *testing.T) {
+	config.JWTPublicKey = "shared-secret"
+	defer func() { config.JWTPublicKey = "" }()
+
+	claims := &jwtClaims{SrcPrefix: "https://allowed.example.com/", Subject: "user-1"}
+	token := signHS256(t, "shared-secret", claims)
+
+	r := httptest.NewRequest(http.MethodGet, "/sig/resize:fit:100:100/"+encodeAdvancedSource("https://allowed.example.com/a.jpg", "jpg"), nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	called := false
+	withJWT(func(reqID string, rw http.ResponseWriter, req *http.Request) {
+		called = true
+		got, ok := ClaimsFromContext(req.Context())
+		if !ok || got.Subject != "user-1" {
+			t.Fatalf("expected claims to be stashed in the request context, got %v (ok=%v)", got, ok)
+		}
+	})("req-1", httptest.NewRecorder(), r)
+
+	if !called {
+		t.Fatal("expected the handler to run for a valid, in-scope token")
+	}
+}
@@ -3,35 +3,150 @@ package main
 import (
 	"context"
 	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	golog "log"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/netutil"
 
+	"github.com/imgproxy/imgproxy/v3/certs"
 	"github.com/imgproxy/imgproxy/v3/config"
+	"github.com/imgproxy/imgproxy/v3/crashreport"
 	"github.com/imgproxy/imgproxy/v3/errorreport"
+	"github.com/imgproxy/imgproxy/v3/httpcache"
 	"github.com/imgproxy/imgproxy/v3/ierrors"
 	"github.com/imgproxy/imgproxy/v3/metrics"
 	"github.com/imgproxy/imgproxy/v3/reuseport"
 	"github.com/imgproxy/imgproxy/v3/router"
+	"github.com/imgproxy/imgproxy/v3/transport"
 	"github.com/imgproxy/imgproxy/v3/vips"
 )
 
+// crashStore buffers panics to disk so reporter latency/outages can't add to
+// request latency or lose a report. nil (and reportCrash synchronous)
+// unless IMGPROXY_CRASH_DIR is configured. Built lazily by startServer,
+// rather than a package-level var initializer, so config has already been
+// populated from the environment by the time it's read.
+var crashStore *crashreport.Store
+
+func newCrashStore() *crashreport.Store {
+	if len(config.CrashDir) == 0 {
+		return nil
+	}
+
+	s, err := crashreport.New(config.CrashDir, config.CrashDirMaxSizeMB)
+	if err != nil {
+		log.Warnf("Can't initialize crash store, falling back to synchronous reporting: %s", err)
+		return nil
+	}
+
+	return s
+}
+
+// uploadCrash is the crashreport.Uploader used to drain the disk-backed
+// crash queue to the configured error reporter. It rebuilds enough of the
+// original request/metadata for the report to carry the same request ID
+// and stack trace a synchronous errorreport.Report(err, r) call would have.
+func uploadCrash(ctx context.Context, env *crashreport.Envelope) error {
+	req, err := http.NewRequestWithContext(ctx, env.Method, env.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = env.Header
+
+	reportCtx := errorreport.StartRequest(req)
+	req = req.WithContext(reportCtx)
+
+	errorreport.SetMetadata(req, "Request ID", env.RequestID)
+	errorreport.SetMetadata(req, "Stack", env.Stack)
+
+	if err := errorreport.Report(errors.New(env.Error), req); err != nil {
+		if sc, ok := reporterStatusCode(err); ok && sc >= 400 && sc < 500 {
+			return &crashreport.UploadError{StatusCode: sc, Err: err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// reporterStatusCode extracts the reporter's HTTP status code from err, if
+// any, so uploadCrash can tell a permanent rejection (4xx) from a transient
+// failure worth retrying.
+func reporterStatusCode(err error) (int, bool) {
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode(), true
+	}
+	return 0, false
+}
+
+// reportCrash hands err off to the disk-backed crash queue so reporting
+// can't add reporter latency (or outages) to the request, falling back to
+// reporting synchronously if the queue isn't configured or can't be
+// written to.
+func reportCrash(reqID string, r *http.Request, err error) {
+	if crashStore == nil {
+		errorreport.Report(err, r)
+		return
+	}
+
+	env := crashreport.NewEnvelope(reqID, r, string(debug.Stack()), err)
+
+	if serr := crashStore.Enqueue(env); serr != nil {
+		log.Warnf("Can't enqueue crash report, reporting synchronously: %s", serr)
+		errorreport.Report(err, r)
+	}
+}
+
+// responseCache is nil (and withHTTPCache a no-op) unless
+// IMGPROXY_RESPONSE_CACHE_SIZE_MB is configured. Built lazily by
+// startServer, rather than a package-level var initializer, so config has
+// already been populated from the environment by the time it's read.
+var responseCache *httpcache.Cache
+
+func newResponseCache() *httpcache.Cache {
+	if config.ResponseCacheSizeMB <= 0 {
+		return nil
+	}
+
+	maxTTL := time.Duration(config.ResponseCacheMaxTTL) * time.Second
+	staleGrace := time.Duration(config.ResponseCacheStaleGrace) * time.Second
+
+	return httpcache.New(config.ResponseCacheSizeMB, maxTTL, staleGrace)
+}
+
 var imgproxyIsRunningMsg = []byte("imgproxy is running")
 
 func buildRouter() *router.Router {
 	r := router.New(config.PathPrefix)
 
-	r.GET("/", handleLanding, true)
-	r.GET("", handleLanding, true)
+	// Built here, rather than in a package-level var, so IMGPROXY_MAX_PROCESSING_IN_FLIGHT
+	// and IMGPROXY_MAX_LIGHTWEIGHT_IN_FLIGHT are read after config.Configure has
+	// populated them, not at package-init time.
+	//
+	// processingInFlight and lightweightInFlight cap concurrency separately for
+	// heavy image processing requests and cheap requests (HEAD, OPTIONS, the
+	// landing page), so a burst of processing work can't starve the endpoints
+	// operators rely on to tell whether imgproxy is still alive. The health
+	// check handler is not wrapped by either limiter.
+	processingInFlight := newInFlightLimiter("processing", config.MaxProcessingInFlight)
+	lightweightInFlight := newInFlightLimiter("lightweight", config.MaxLightweightInFlight)
 
-	r.GET("/", withMetrics(withPanicHandler(withCORS(withSecret(handleProcessing)))), false)
+	r.GET("/", withMaxInFlight(lightweightInFlight, handleLanding), true)
+	r.GET("", withMaxInFlight(lightweightInFlight, handleLanding), true)
 
-	r.HEAD("/", withCORS(handleHead), false)
-	r.OPTIONS("/", withCORS(handleHead), false)
+	r.GET("/", withMetrics(withPanicHandler(withCORS(withAuth(withMaxInFlight(processingInFlight, withHTTPCache(handleProcessing)))))), false)
+
+	r.HEAD("/", withCORS(withMaxInFlight(lightweightInFlight, handleHead)), false)
+	r.OPTIONS("/", withCORS(withMaxInFlight(lightweightInFlight, handleHead)), false)
 
 	r.HealthHandler = handleHealth
 
@@ -39,11 +154,28 @@ func buildRouter() *router.Router {
 }
 
 func startServer(cancel context.CancelFunc) (*http.Server, error) {
+	// Source image downloads go through http.DefaultTransport (directly or
+	// via http.DefaultClient), so swapping it here is what makes
+	// IMGPROXY_SOURCE_HTTP_PROXY/HTTPS_PROXY/NO_PROXY actually take effect.
+	http.DefaultTransport = transport.Default()
+
+	crashStore = newCrashStore()
+	responseCache = newResponseCache()
+
 	l, err := reuseport.Listen(config.Network, config.Bind)
 	if err != nil {
 		return nil, fmt.Errorf("Can't start server: %s", err)
 	}
 
+	l, err = wrapTLSListener(l)
+	if err != nil {
+		return nil, err
+	}
+
+	if crashStore != nil {
+		go crashStore.Run(context.Background(), uploadCrash)
+	}
+
 	if config.MaxClients > 0 {
 		l = netutil.LimitListener(l, config.MaxClients)
 	}
@@ -77,6 +209,42 @@ func startServer(cancel context.CancelFunc) (*http.Server, error) {
 	return s, nil
 }
 
+// wrapTLSListener wraps l with TLS termination when either a certificate
+// directory or self-signed mode is configured. Certificates are selected by
+// SNI through certs.Manager, which hot-reloads the lookup table when the
+// certificate directory changes. The listener advertises h2 over ALPN
+// alongside HTTP/1.1.
+func wrapTLSListener(l net.Listener) (net.Listener, error) {
+	var (
+		mgr *certs.Manager
+		err error
+	)
+
+	switch {
+	case config.TLSSelfSigned:
+		mgr, err = certs.NewSelfSigned([]string{"localhost"})
+	case len(config.TLSCertDir) > 0:
+		mgr, err = certs.New(config.TLSCertDir, config.TLSKeyDir)
+		if err == nil {
+			err = mgr.Watch()
+		}
+	default:
+		return l, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't initialize TLS: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: mgr.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	return tls.NewListener(l, tlsConfig), nil
+}
+
 func shutdownServer(s *http.Server) {
 	log.Info("Shutting down the server...")
 
@@ -110,6 +278,101 @@ func withCORS(h router.RouteHandler) router.RouteHandler {
 	}
 }
 
+// inFlightLimiter is a bounded, named semaphore for a group of routes.
+// Requests that can't acquire a slot within queueTimeout are rejected rather
+// than queued indefinitely, mirroring the max-in-flight limiter used by the
+// Kubernetes API server to separate "long-running"/lightweight requests from
+// regular ones.
+type inFlightLimiter struct {
+	name         string
+	sem          chan struct{}
+	queueTimeout time.Duration
+}
+
+func newInFlightLimiter(name string, limit int) *inFlightLimiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &inFlightLimiter{
+		name:         name,
+		sem:          make(chan struct{}, limit),
+		queueTimeout: time.Duration(config.InFlightQueueTimeout) * time.Second,
+	}
+}
+
+func (l *inFlightLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	if l.queueTimeout <= 0 {
+		select {
+		case l.sem <- struct{}{}:
+			metrics.SetInFlightRequests(l.name, len(l.sem))
+			return true
+		default:
+			metrics.IncRejectedRequests(l.name)
+			return false
+		}
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.sem <- struct{}{}:
+		metrics.SetInFlightRequests(l.name, len(l.sem))
+		return true
+	case <-timer.C:
+		metrics.IncRejectedRequests(l.name)
+		return false
+	}
+}
+
+func (l *inFlightLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.sem
+	metrics.SetInFlightRequests(l.name, len(l.sem))
+}
+
+func withMaxInFlight(limiter *inFlightLimiter, h router.RouteHandler) router.RouteHandler {
+	if limiter == nil {
+		return h
+	}
+
+	retryAfter := strconv.Itoa(int(limiter.queueTimeout.Seconds()) + 1)
+
+	return func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		if !limiter.acquire() {
+			rw.Header().Set("Retry-After", retryAfter)
+			panic(newInFlightTimeoutError())
+		}
+		defer limiter.release()
+
+		h(reqID, rw, r)
+	}
+}
+
+// withHTTPCache serves cached processing responses, revalidating stale
+// entries in the background, when a response cache is configured.
+func withHTTPCache(h router.RouteHandler) router.RouteHandler {
+	if responseCache == nil {
+		return h
+	}
+
+	return func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		key := httpcache.Key(r)
+
+		responseCache.Serve(rw, r, key, func(crw http.ResponseWriter, cr *http.Request) {
+			h(reqID, crw, cr)
+		})
+	}
+}
+
 func withSecret(h router.RouteHandler) router.RouteHandler {
 	if len(config.Secret) == 0 {
 		return h
@@ -147,7 +410,7 @@ func withPanicHandler(h router.RouteHandler) router.RouteHandler {
 				ierr := ierrors.Wrap(err, 0)
 
 				if ierr.ShouldReport() {
-					errorreport.Report(err, r)
+					reportCrash(reqID, r, err)
 				}
 
 				router.LogResponse(reqID, r, ierr.StatusCode(), ierr)
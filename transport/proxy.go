@@ -0,0 +1,184 @@
+// Package transport builds the http.Transport used to fetch source images,
+// adding support for fetching through a corporate forward proxy.
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/imgproxy/imgproxy/v3/config"
+	"github.com/imgproxy/imgproxy/v3/ierrors"
+)
+
+var (
+	defaultOnce      sync.Once
+	defaultTransport *http.Transport
+)
+
+// Default returns the http.Transport source image downloads should use, so
+// that IMGPROXY_SOURCE_HTTP_PROXY/HTTPS_PROXY/NO_PROXY and the CONNECT-tunnel
+// proxy-auth logic in this package actually take effect. Built lazily, on
+// first call, so config has already been populated from the environment.
+func Default() *http.Transport {
+	defaultOnce.Do(func() {
+		base, ok := http.DefaultTransport.(*http.Transport)
+		if !ok {
+			base = &http.Transport{}
+		}
+		defaultTransport = NewSourceTransport(base)
+	})
+
+	return defaultTransport
+}
+
+// SourceProxyError wraps a failure to reach the configured source proxy
+// (dial, CONNECT, or the subsequent TLS handshake), distinct from generic
+// source download errors so it can be reported with its own status code.
+type SourceProxyError struct{ error }
+
+func newSourceProxyError(cause error) *ierrors.Error {
+	return ierrors.Wrap(
+		SourceProxyError{cause},
+		1,
+		ierrors.WithStatusCode(http.StatusBadGateway),
+		ierrors.WithPublicMessage("Error downloading image"),
+	)
+}
+
+func (e SourceProxyError) Error() string {
+	return fmt.Sprintf("Can't reach source proxy: %s", e.error)
+}
+
+func (e SourceProxyError) Unwrap() error { return e.error }
+
+// NewSourceTransport clones base and configures it to fetch source images
+// through IMGPROXY_SOURCE_HTTP_PROXY/IMGPROXY_SOURCE_HTTPS_PROXY, honoring
+// IMGPROXY_SOURCE_NO_PROXY. HTTPS origins are reached through an explicit,
+// optionally authenticated, CONNECT tunnel rather than relying on
+// Transport's built-in (unauthenticated) CONNECT support.
+func NewSourceTransport(base *http.Transport) *http.Transport {
+	proxyCfg := &httpproxy.Config{
+		HTTPProxy:  config.SourceHTTPProxy,
+		HTTPSProxy: config.SourceHTTPSProxy,
+		NoProxy:    config.SourceNoProxy,
+	}
+	proxyFunc := proxyCfg.ProxyFunc()
+
+	t := base.Clone()
+
+	t.Proxy = func(r *http.Request) (*url.URL, error) {
+		// HTTPS origins are tunneled by DialTLSContext below; returning a
+		// proxy here would make Transport issue its own CONNECT instead.
+		if r.URL.Scheme == "https" {
+			return nil, nil
+		}
+		return proxyFunc(r.URL)
+	}
+
+	dialTLSContext := t.DialTLSContext
+
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		proxyURL, err := proxyFunc(&url.URL{Scheme: "https", Host: addr})
+		if err != nil {
+			return nil, newSourceProxyError(fmt.Errorf("can't resolve proxy for %s: %s", addr, err))
+		}
+
+		if proxyURL == nil {
+			if dialTLSContext != nil {
+				return dialTLSContext(ctx, network, addr)
+			}
+			return (&tls.Dialer{Config: t.TLSClientConfig}).DialContext(ctx, network, addr)
+		}
+
+		return dialViaConnect(ctx, proxyURL, addr, t.TLSClientConfig)
+	}
+
+	return t
+}
+
+// dialViaConnect dials proxyURL, issues an explicit CONNECT to addr with
+// Proxy-Authorization (from the proxy URL's userinfo, or the configured
+// header), and wraps the tunnel in TLS with addr's host as the SNI/verified
+// name. tlsConfig is cloned from the transport's own TLSClientConfig (custom
+// CAs, client certs, InsecureSkipVerify, ...) so proxied fetches get the same
+// TLS behavior as direct ones; only ServerName is overridden per-dial.
+func dialViaConnect(ctx context.Context, proxyURL *url.URL, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := connectTunnel(ctx, proxyURL, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	cfg := tlsConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg.ServerName = host
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tlsConn.Close()
+		return nil, newSourceProxyError(fmt.Errorf("TLS handshake with %s via proxy failed: %s", addr, err))
+	}
+
+	return tlsConn, nil
+}
+
+// connectTunnel dials proxyURL and issues an explicit CONNECT for addr,
+// returning the raw (pre-TLS) tunnel once the proxy answers 200.
+func connectTunnel(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, newSourceProxyError(fmt.Errorf("can't dial proxy %s: %s", proxyURL.Host, err))
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", addr, addr, proxyAuthHeader(proxyURL))
+
+	if _, err = conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, newSourceProxyError(fmt.Errorf("can't write CONNECT request to %s: %s", proxyURL.Host, err))
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, newSourceProxyError(fmt.Errorf("can't read CONNECT response from %s: %s", proxyURL.Host, err))
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, newSourceProxyError(fmt.Errorf("proxy CONNECT to %s via %s failed: %s", addr, proxyURL.Host, resp.Status))
+	}
+
+	return conn, nil
+}
+
+func proxyAuthHeader(proxyURL *url.URL) string {
+	if proxyURL.User != nil {
+		pass, _ := proxyURL.User.Password()
+		token := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + pass))
+		return fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", token)
+	}
+
+	if len(config.SourceProxyAuthorizationHeader) > 0 {
+		return fmt.Sprintf("Proxy-Authorization: %s\r\n", config.SourceProxyAuthorizationHeader)
+	}
+
+	return ""
+}
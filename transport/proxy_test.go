@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProxy accepts a single connection, reads the CONNECT request line and
+// headers, hands them to onConnect, then writes status as the response.
+func fakeProxy(t *testing.T, status string, onConnect func(requestLine string, headers []string)) *url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+
+		requestLine, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		var headers []string
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || strings.TrimRight(line, "\r\n") == "" {
+				break
+			}
+			headers = append(headers, strings.TrimRight(line, "\r\n"))
+		}
+
+		if onConnect != nil {
+			onConnect(strings.TrimRight(requestLine, "\r\n"), headers)
+		}
+
+		conn.Write([]byte(status))
+	}()
+
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestConnectTunnelSucceeds(t *testing.T) {
+	var gotLine string
+	var gotHeaders []string
+
+	proxyURL := fakeProxy(t, "HTTP/1.1 200 Connection Established\r\n\r\n", func(line string, headers []string) {
+		gotLine = line
+		gotHeaders = headers
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := connectTunnel(ctx, proxyURL, "example.com:443")
+	if err != nil {
+		t.Fatalf("connectTunnel: %s", err)
+	}
+	defer conn.Close()
+
+	if gotLine != "CONNECT example.com:443 HTTP/1.1" {
+		t.Fatalf("unexpected CONNECT request line: %q", gotLine)
+	}
+
+	found := false
+	for _, h := range gotHeaders {
+		if strings.HasPrefix(h, "Host:") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected a Host header on the CONNECT request, got %v", gotHeaders)
+	}
+}
+
+func TestConnectTunnelSendsProxyAuthFromUserinfo(t *testing.T) {
+	var gotHeaders []string
+
+	proxyURL := fakeProxy(t, "HTTP/1.1 200 Connection Established\r\n\r\n", func(_ string, headers []string) {
+		gotHeaders = headers
+	})
+	proxyURL.User = url.UserPassword("alice", "s3cret")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := connectTunnel(ctx, proxyURL, "example.com:443")
+	if err != nil {
+		t.Fatalf("connectTunnel: %s", err)
+	}
+	defer conn.Close()
+
+	wantToken := base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))
+	want := "Proxy-Authorization: Basic " + wantToken
+
+	found := false
+	for _, h := range gotHeaders {
+		if h == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected header %q among %v", want, gotHeaders)
+	}
+}
+
+func TestConnectTunnelFailsOnNonOKStatus(t *testing.T) {
+	proxyURL := fakeProxy(t, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := connectTunnel(ctx, proxyURL, "example.com:443")
+	if err == nil {
+		t.Fatal("expected connectTunnel to fail on a non-200 CONNECT response")
+	}
+	if !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected the error to mention the proxy's status, got: %s", err)
+	}
+}
+
+func TestConnectTunnelFailsWhenProxyUnreachable(t *testing.T) {
+	// A closed listener's address is guaranteed to refuse connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = connectTunnel(context.Background(), &url.URL{Host: addr}, "example.com:443")
+	if err == nil {
+		t.Fatal("expected connectTunnel to fail when the proxy is unreachable")
+	}
+}
+
+func TestProxyAuthHeaderFromUserinfo(t *testing.T) {
+	u := &url.URL{Host: "proxy.internal:3128", User: url.UserPassword("bob", "hunter2")}
+
+	got := proxyAuthHeader(u)
+	want := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("bob:hunter2")) + "\r\n"
+
+	if got != want {
+		t.Fatalf("proxyAuthHeader() = %q, want %q", got, want)
+	}
+}
+
+func TestProxyAuthHeaderEmptyWithoutUserinfoOrConfig(t *testing.T) {
+	u := &url.URL{Host: "proxy.internal:3128"}
+
+	if got := proxyAuthHeader(u); got != "" {
+		t.Fatalf("expected no Proxy-Authorization header, got %q", got)
+	}
+}